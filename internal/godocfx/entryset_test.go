@@ -0,0 +1,55 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build go1.15
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestEntrySetDedup(t *testing.T) {
+	s := newEntrySet()
+	e := indexEntry{Path: "example.com/foo", Version: "v1.0.0"}
+	s.add(e)
+	s.add(e) // duplicate
+	s.add(indexEntry{Path: "example.com/bar", Version: "v1.0.0"})
+
+	got := s.entries()
+	if len(got) != 2 {
+		t.Fatalf("entries() returned %d entries, want 2: %v", len(got), got)
+	}
+}
+
+func TestEntrySetConcurrentAdd(t *testing.T) {
+	s := newEntrySet()
+	const n = 500
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.add(indexEntry{Path: "example.com/mod", Version: fmt.Sprintf("v1.0.%d", i)})
+		}(i)
+	}
+	wg.Wait()
+
+	if got := len(s.entries()); got != n {
+		t.Fatalf("entries() returned %d entries, want %d", got, n)
+	}
+}
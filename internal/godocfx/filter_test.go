@@ -0,0 +1,57 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build go1.15
+
+package main
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*/internal/*", "example.com/foo/internal/bar", true},
+		{"*/internal/*", "example.com/internal", false},
+		{"*/internal", "example.com/foo/internal", true},
+		{"internal/*", "internal/foo", true},
+		{"example.com/*", "example.com/foo/bar", true},
+		{"example.com/foo", "example.com/bar", false},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestIsPseudoVersion(t *testing.T) {
+	tests := []struct {
+		v    string
+		want bool
+	}{
+		{"v0.0.0-20190311183353-d8887717615a", true},
+		{"v1.2.4-0.20190311183353-d8887717615a", true},
+		{"v1.2.3-pre.0.20190311183353-d8887717615a", true},
+		{"v1.2.3-rc1", false},
+		{"v1.2.3", false},
+		{"v1.2.3+incompatible", false},
+	}
+	for _, tt := range tests {
+		if got := isPseudoVersion(tt.v); got != tt.want {
+			t.Errorf("isPseudoVersion(%q) = %v, want %v", tt.v, got, tt.want)
+		}
+	}
+}
@@ -21,21 +21,72 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"math/rand"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type indexer interface {
-	get(prefix string, since time.Time) (entries []indexEntry, err error)
+	get(ctx context.Context, prefix string, since time.Time, filter Filter) (entries []indexEntry, err error)
+
+	// concurrency reports how many workers newModules should use to fetch
+	// index pages in parallel.
+	concurrency() int
 }
 
 // indexClient is used to access index.golang.org.
-type indexClient struct{}
+//
+// The zero value is not ready to use; call newIndexClient to get an
+// indexClient with sensible retry defaults.
+type indexClient struct {
+	// HTTPClient is used to make requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// MaxRetries is the maximum number of attempts for a single page fetch,
+	// including the first attempt.
+	MaxRetries int
+
+	// MinBackoff and MaxBackoff bound the exponential backoff applied
+	// between retries. A Retry-After header on a 429 or 503 response
+	// overrides the computed backoff for that attempt.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// RequestTimeout bounds a single HTTP round trip, separate from any
+	// deadline on the context passed to get.
+	RequestTimeout time.Duration
+
+	// Concurrency is the number of worker goroutines newModules uses to
+	// fetch index pages in parallel. Values less than 1 are treated as 1.
+	Concurrency int
+}
 
 var _ indexer = indexClient{}
 
+// newIndexClient returns an indexClient with default retry settings.
+func newIndexClient() indexClient {
+	return indexClient{
+		MaxRetries:     5,
+		MinBackoff:     1 * time.Second,
+		MaxBackoff:     30 * time.Second,
+		RequestTimeout: 30 * time.Second,
+		Concurrency:    10,
+	}
+}
+
+func (c indexClient) concurrency() int {
+	if c.Concurrency < 1 {
+		return 1
+	}
+	return c.Concurrency
+}
+
 // indexEntry represents a line in the output of index.golang.org/index.
 type indexEntry struct {
 	Path      string
@@ -43,76 +94,485 @@ type indexEntry struct {
 	Timestamp time.Time
 }
 
+// PseudoVersionPolicy controls how a Filter treats pseudo-versions, i.e.
+// versions of the form vX.Y.Z-yyyymmddhhmmss-abcdefabcdef that tools
+// generate for commits with no matching tag.
+type PseudoVersionPolicy int
+
+const (
+	// PseudoVersionsInclude keeps both pseudo-versions and tagged versions.
+	PseudoVersionsInclude PseudoVersionPolicy = iota
+	// PseudoVersionsExclude drops pseudo-versions, keeping only tagged
+	// versions. This is the historical godocfx behavior.
+	PseudoVersionsExclude
+	// PseudoVersionsOnly drops tagged versions, keeping only pseudo-versions.
+	PseudoVersionsOnly
+)
+
+// Filter controls which (path, version) pairs returned by
+// index.golang.org are kept.
+//
+// Include and Exclude are glob patterns matched against the module path,
+// where "*" matches any sequence of characters, including "/". A path is
+// kept if it matches no Exclude pattern and, whenever Include is
+// non-empty, matches at least one Include pattern.
+type Filter struct {
+	Include        []string
+	Exclude        []string
+	PseudoVersions PseudoVersionPolicy
+}
+
+// DefaultFilter returns the filter godocfx has historically applied:
+// internal and third_party packages are skipped, and pseudo-versions are
+// excluded in favor of tagged releases.
+func DefaultFilter() Filter {
+	return Filter{
+		Exclude: []string{
+			"*/internal/*", "*/internal", "internal/*",
+			"*/third_party/*", "*/third_party", "third_party/*",
+		},
+		PseudoVersions: PseudoVersionsExclude,
+	}
+}
+
+// allows reports whether the given module path and version pass the
+// filter.
+func (f Filter) allows(path, version string) bool {
+	for _, pat := range f.Exclude {
+		if globMatch(pat, path) {
+			return false
+		}
+	}
+	if len(f.Include) > 0 {
+		matched := false
+		for _, pat := range f.Include {
+			if globMatch(pat, path) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	switch f.PseudoVersions {
+	case PseudoVersionsExclude:
+		if isPseudoVersion(version) {
+			return false
+		}
+	case PseudoVersionsOnly:
+		if !isPseudoVersion(version) {
+			return false
+		}
+	}
+	return true
+}
+
+// globCache memoizes the regexp compiled for each glob pattern seen by
+// globMatch, so filtering a page of entries doesn't recompile the same
+// Include/Exclude patterns for every entry on the page.
+var globCache sync.Map // pattern string -> *regexp.Regexp
+
+// compileGlob translates pattern into an anchored regexp and caches the
+// result, compiling it only the first time pattern is seen.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	if cached, ok := globCache.Load(pattern); ok {
+		return cached.(*regexp.Regexp), nil
+	}
+
+	var b strings.Builder
+	b.WriteByte('^')
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteByte('$')
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, err
+	}
+	globCache.Store(pattern, re)
+	return re, nil
+}
+
+// globMatch reports whether s matches the glob pattern, where "*" matches
+// any sequence of characters (including "/") and "?" matches exactly one
+// character. Unlike path.Match, "*" is not blocked by path separators,
+// since module paths are the things being matched, not filesystem paths.
+func globMatch(pattern, s string) bool {
+	re, err := compileGlob(pattern)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(s)
+}
+
+// pseudoVersionRE mirrors the pseudo-version regexp golang.org/x/mod/module
+// uses, covering all three pseudo-version forms: no base version
+// (v0.0.0-yyyymmddhhmmss-abcdefabcdef), a patch-incremented base
+// (vX.Y.Z-0.yyyymmddhhmmss-abcdefabcdef), and a prerelease base
+// (vX.Y.Z-pre.0.yyyymmddhhmmss-abcdefabcdef). A prior version of this
+// regexp only recognized the unprefixed "0." form and misclassified
+// prerelease-based pseudo-versions like
+// "v1.2.3-pre.0.20190311183353-d8887717615a" as tagged releases.
+var pseudoVersionRE = regexp.MustCompile(`^v[0-9]+\.(0\.0-|\d+\.\d+-([^+]*\.)?0\.)\d{14}-[A-Za-z0-9]+(\+incompatible)?$`)
+
+// isPseudoVersion reports whether v has the shape of a Go pseudo-version.
+// Matching the well-known pseudo-version grammar, rather than rejecting any
+// version containing a "-", correctly keeps hand-chosen prerelease tags
+// like "v1.2.3-rc1".
+func isPseudoVersion(v string) bool {
+	return pseudoVersionRE.MatchString(v)
+}
+
 // newModules returns the new modules with the given prefix.
 //
 // newModules uses index.golang.org/index?since=timestamp to find new module
-// versions since the given timestamp.
+// versions since the given timestamp. The first page is fetched serially to
+// establish a cursor; remaining pages, up to i.concurrency() of them at a
+// time, are fetched by a pool of workers each walking its own slice of the
+// [since, fiveMinAgo) range, so a multi-day backlog doesn't pay for
+// thousands of sequential round trips.
 //
 // newModules stores the timestamp of the last successful run in Datastore. If
 // there is no value in Datastore, newModules defaults to 10 days ago.
-func newModules(ctx context.Context, i indexer, tSaver timeSaver, prefix string) ([]indexEntry, error) {
+//
+// filter controls which module paths and versions are kept; pass
+// DefaultFilter() for the historical behavior of skipping internal,
+// third_party, and pseudo-version entries.
+func newModules(ctx context.Context, i indexer, tSaver timeSaver, prefix string, filter Filter) ([]indexEntry, error) {
 	since, err := tSaver.get(ctx)
 	if err != nil {
 		return nil, err
 	}
 	fiveMinAgo := time.Now().Add(-5 * time.Minute).UTC() // When to stop processing.
-	// Use a map to prevent duplicates.
-	entries := map[indexEntry]struct{}{}
+	sink := newEntrySet()
 	log.Printf("Fetching index.golang.org entries since %s", since.Format(time.RFC3339))
-	count := 0
-	for {
-		count++
-		cur, err := i.get(prefix, since)
+
+	first, err := i.get(ctx, prefix, since, filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(first) == 0 {
+		return nil, fmt.Errorf("Found 0 entries in index response")
+	}
+	sink.addAll(first)
+	cursor := first[len(first)-1].Timestamp
+
+	if cursor.Before(fiveMinAgo) {
+		cursor, err = paginate(ctx, i, sink, prefix, filter, cursor, fiveMinAgo)
 		if err != nil {
 			return nil, err
 		}
-		if len(cur) == 0 {
-			return nil, fmt.Errorf("Found 0 entries in index response")
-		}
-		since = cur[len(cur)-1].Timestamp
-		for _, e := range cur {
-			entries[e] = struct{}{}
-		}
-		if since.After(fiveMinAgo) {
-			break
-		}
 	}
-	log.Printf("Parsed %d index.golang.org pages up to %s", count, since.Format(time.RFC3339))
-	if err := tSaver.put(ctx, since); err != nil {
+
+	log.Printf("Parsed index.golang.org pages up to %s", cursor.Format(time.RFC3339))
+	if err := tSaver.put(ctx, cursor); err != nil {
 		return nil, err
 	}
 
+	return sink.entries(), nil
+}
+
+// paginate fetches all remaining index pages in [start, end) using up to
+// i.concurrency() worker goroutines. The range is split into that many
+// equal-width buckets, each walked serially by its own worker; the workers
+// themselves run concurrently. Entries are deduplicated into sink as they
+// arrive.
+//
+// paginate returns the maximum timestamp successfully processed across all
+// workers. That, not the cursor of whichever worker happens to return last,
+// is what's safe to persist: goroutine completion order is arbitrary, and
+// saving a worker's cursor just because it finished last could skip over
+// entries a slower worker hadn't reached yet.
+//
+// A worker whose window turns up no matching entries simply stops,
+// contributing whatever cursor it had already reached; it does not abort
+// its siblings or the already-gathered results, since an empty window is
+// an ordinary outcome for a narrow prefix/Filter, not a failure.
+func paginate(ctx context.Context, i indexer, sink *entrySet, prefix string, filter Filter, start, end time.Time) (time.Time, error) {
+	n := i.concurrency()
+	bucket := end.Sub(start) / time.Duration(n)
+	if bucket <= 0 {
+		n, bucket = 1, end.Sub(start)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		maxSeen  = start
+		errOnce  sync.Once
+		firstErr error
+	)
+
+	for w := 0; w < n; w++ {
+		bucketStart := start.Add(bucket * time.Duration(w))
+		bucketEnd := end
+		if w < n-1 {
+			bucketEnd = start.Add(bucket * time.Duration(w+1))
+		}
+
+		wg.Add(1)
+		go func(since, until time.Time) {
+			defer wg.Done()
+			for since.Before(until) {
+				cur, err := i.get(ctx, prefix, since, filter)
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					return
+				}
+				if len(cur) == 0 {
+					// Nothing in this worker's window matched prefix/filter.
+					// That's an everyday outcome for a narrow filter against a
+					// sparsely populated time range, not a sign of trouble
+					// with index.golang.org: unlike the single-chain serial
+					// walk, a bucket's "since" is a synthetic split point, not
+					// a cursor derived from a real prior page, so an empty
+					// result here says nothing about the other buckets. Stop
+					// this worker without touching firstErr, so an ordinary
+					// quiet window can't abort the batch and discard every
+					// other worker's already-collected entries.
+					break
+				}
+				sink.addAll(cur)
+				since = cur[len(cur)-1].Timestamp
+			}
+			mu.Lock()
+			if since.After(maxSeen) {
+				maxSeen = since
+			}
+			mu.Unlock()
+		}(bucketStart, bucketEnd)
+	}
+
+	wg.Wait()
+	if firstErr != nil {
+		return time.Time{}, firstErr
+	}
+	return maxSeen, nil
+}
+
+const entrySetShards = 32
+
+// entryShard is one lock-guarded partition of an entrySet.
+type entryShard struct {
+	mu sync.Mutex
+	m  map[indexEntry]struct{}
+}
+
+// entrySet is a concurrency-safe set of indexEntry values, sharded across
+// several mutex-guarded maps so that concurrent pagination workers rarely
+// contend on the same lock.
+type entrySet struct {
+	shards [entrySetShards]*entryShard
+}
+
+func newEntrySet() *entrySet {
+	s := &entrySet{}
+	for i := range s.shards {
+		s.shards[i] = &entryShard{m: map[indexEntry]struct{}{}}
+	}
+	return s
+}
+
+func (s *entrySet) shardFor(e indexEntry) *entryShard {
+	h := fnv.New32a()
+	h.Write([]byte(e.Path + "@" + e.Version))
+	return s.shards[h.Sum32()%entrySetShards]
+}
+
+func (s *entrySet) add(e indexEntry) {
+	sh := s.shardFor(e)
+	sh.mu.Lock()
+	sh.m[e] = struct{}{}
+	sh.mu.Unlock()
+}
+
+func (s *entrySet) addAll(es []indexEntry) {
+	for _, e := range es {
+		s.add(e)
+	}
+}
+
+func (s *entrySet) entries() []indexEntry {
 	result := []indexEntry{}
-	for e := range entries {
-		result = append(result, e)
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		for e := range sh.m {
+			result = append(result, e)
+		}
+		sh.mu.Unlock()
 	}
-	return result, nil
+	return result
 }
 
-// get fetches a single page of modules from index.golang.org/index.
+// get fetches a single page of modules from index.golang.org/index, retrying
+// on transient errors with capped exponential backoff and jitter.
 //
 // last is the time of the latest module in the list.
-func (indexClient) get(prefix string, since time.Time) ([]indexEntry, error) {
-	entries := []indexEntry{}
+//
+// get honors ctx cancellation both between and during retries; an in-flight
+// request is aborted as soon as ctx is done.
+func (c indexClient) get(ctx context.Context, prefix string, since time.Time, filter Filter) ([]indexEntry, error) {
 	sinceString := since.Format(time.RFC3339)
-	resp, err := http.Get("https://index.golang.org/index?since=" + sinceString)
+	url := "https://index.golang.org/index?since=" + sinceString
+
+	maxRetries := c.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = 1
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		if attempt > 0 {
+			d := c.backoff(attempt, lastErr)
+			log.Printf("index.golang.org: retrying after %s (attempt %d/%d): %v", d, attempt+1, maxRetries, lastErr)
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		entries, retryAfter, err := c.getOnce(ctx, url, prefix, filter)
+		if err == nil {
+			return entries, nil
+		}
+		if !isRetryable(err) {
+			return nil, err
+		}
+		lastErr = err
+		if retryAfter > 0 {
+			// Override the computed backoff with the server's explicit wait.
+			lastErr = retryAfterError{err: err, wait: retryAfter}
+		}
+	}
+	return nil, fmt.Errorf("index.golang.org: giving up after %d attempts: %w", maxRetries, lastErr)
+}
+
+// getOnce issues a single HTTP request for one page of the index. retryAfter
+// is non-zero when the response carried a Retry-After header.
+func (c indexClient) getOnce(ctx context.Context, url, prefix string, filter Filter) (entries []indexEntry, retryAfter time.Duration, err error) {
+	reqCtx := ctx
+	if c.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, c.RequestTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
 	}
+	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		return nil, retryAfter, fmt.Errorf("index.golang.org: status %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("index.golang.org: status %s", resp.Status)
+	}
+
+	entries = []indexEntry{}
 	s := bufio.NewScanner(resp.Body)
 	for s.Scan() {
 		e := indexEntry{}
 		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-		if !strings.HasPrefix(e.Path, prefix) ||
-			strings.Contains(e.Path, "internal") ||
-			strings.Contains(e.Path, "third_party") ||
-			strings.Contains(e.Version, "-") { // Filter out pseudo-versions.
+		if !strings.HasPrefix(e.Path, prefix) || !filter.allows(e.Path, e.Version) {
 			continue
 		}
 		entries = append(entries, e)
 	}
-	return entries, nil
+	return entries, 0, s.Err()
+}
+
+// backoff computes how long to wait before the given retry attempt
+// (attempt is 1 for the first retry), honoring a server-specified
+// Retry-After duration carried on err when present.
+func (c indexClient) backoff(attempt int, err error) time.Duration {
+	return computeBackoff(c.MinBackoff, c.MaxBackoff, attempt, err)
+}
+
+// computeBackoff is the capped-exponential-backoff-with-jitter policy
+// shared by indexClient (for index.golang.org) and verifier (for
+// sum.golang.org and the module proxy): it returns how long to wait before
+// the given retry attempt (attempt is 1 for the first retry), honoring a
+// server-specified Retry-After duration carried on err when present.
+func computeBackoff(min, max time.Duration, attempt int, err error) time.Duration {
+	if rae, ok := err.(retryAfterError); ok {
+		return rae.wait
+	}
+
+	if min <= 0 {
+		min = time.Second
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+
+	d := min << uint(attempt-1)
+	if d <= 0 || d > max {
+		d = max
+	}
+	// Full jitter: pick uniformly between 0 and d.
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// retryAfterError wraps a retryable error with an explicit wait duration
+// parsed from a Retry-After response header.
+type retryAfterError struct {
+	err  error
+	wait time.Duration
+}
+
+func (e retryAfterError) Error() string { return e.err.Error() }
+func (e retryAfterError) Unwrap() error { return e.err }
+
+// isRetryable reports whether err is worth retrying. Every non-nil error
+// is, except context.Canceled and context.DeadlineExceeded themselves: it
+// does not tell transient failures (network errors, timeouts, 429s, 5xxs)
+// apart from permanent ones such as a 404 or a malformed response body,
+// which are retried as well.
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	return true
+}
+
+// parseRetryAfter parses a Retry-After header value expressed as a number
+// of seconds. It returns 0 if the header is absent or malformed, in which
+// case the caller falls back to computed exponential backoff.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	secs, err := strconv.Atoi(v)
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
 }
@@ -0,0 +1,78 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build go1.15
+
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIndexer serves indexEntry pages from a fixed, sorted slice, as if it
+// were index.golang.org, filtering by since and reporting an empty page
+// once the slice is exhausted -- exactly the shape a narrow prefix/Filter
+// produces against a sparse time range.
+type fakeIndexer struct {
+	mu      sync.Mutex
+	entries []indexEntry // sorted by Timestamp
+	conc    int
+}
+
+func (f *fakeIndexer) concurrency() int { return f.conc }
+
+func (f *fakeIndexer) get(ctx context.Context, prefix string, since time.Time, filter Filter) ([]indexEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var page []indexEntry
+	for _, e := range f.entries {
+		if e.Timestamp.After(since) {
+			page = append(page, e)
+		}
+		if len(page) >= 1 {
+			// One entry per page, like a real paginated response.
+			break
+		}
+	}
+	return page, nil
+}
+
+// TestPaginateSparseBucketDoesNotAbortSiblings reproduces a narrow
+// prefix/Filter whose matches all cluster in the first of several
+// buckets: later buckets see zero matching entries. That must not abort
+// the earlier bucket's already-gathered results or error the whole call.
+func TestPaginateSparseBucketDoesNotAbortSiblings(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(10 * 24 * time.Hour)
+
+	fi := &fakeIndexer{conc: 10}
+	for i := 1; i <= 5; i++ {
+		fi.entries = append(fi.entries, indexEntry{
+			Path:      "example.com/foo",
+			Version:   "v1.0.0",
+			Timestamp: start.Add(time.Duration(i) * time.Hour), // all within bucket 0
+		})
+	}
+
+	sink := newEntrySet()
+	if _, err := paginate(context.Background(), fi, sink, "example.com", DefaultFilter(), start, end); err != nil {
+		t.Fatalf("paginate() error = %v, want nil", err)
+	}
+	if got := len(sink.entries()); got != len(fi.entries) {
+		t.Errorf("sink has %d entries, want %d -- sparse later buckets must not discard them", got, len(fi.entries))
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build go1.15
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{"0", 0},
+		{"-1", 0},
+		{"not-a-number", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.in); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+var errBoom = errors.New("boom")
+
+func TestIndexClientBackoff(t *testing.T) {
+	c := indexClient{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}
+
+	// A Retry-After wait always wins over the computed backoff.
+	if d := c.backoff(1, retryAfterError{err: errBoom, wait: 7 * time.Second}); d != 7*time.Second {
+		t.Errorf("backoff with Retry-After = %v, want 7s", d)
+	}
+
+	for attempt := 1; attempt <= 5; attempt++ {
+		d := c.backoff(attempt, errBoom)
+		if d < 0 || d > c.MaxBackoff {
+			t.Errorf("backoff(%d) = %v, want in [0, %v]", attempt, d, c.MaxBackoff)
+		}
+	}
+}
+
+// redirectTransport rewrites every request's scheme and host to point at a
+// test server, so code like indexClient.get that hardcodes
+// https://index.golang.org can still be driven against httptest.Server.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func testIndexClient(target *url.URL) indexClient {
+	c := newIndexClient()
+	c.HTTPClient = &http.Client{Transport: redirectTransport{target: target}}
+	c.MinBackoff = time.Millisecond
+	c.MaxBackoff = 5 * time.Millisecond
+	return c
+}
+
+// TestIndexClientGetRetriesTransientErrors confirms get retries 429s and
+// 5xxs rather than failing on the first one, and succeeds once the server
+// starts returning 200s.
+func TestIndexClientGetRetriesTransientErrors(t *testing.T) {
+	var hits int32
+	statuses := []int{http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusOK}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := atomic.AddInt32(&hits, 1) - 1
+		if int(i) >= len(statuses)-1 {
+			fmt.Fprintln(w, `{"Path":"example.com/foo","Version":"v1.0.0"}`)
+			return
+		}
+		w.WriteHeader(statuses[i])
+	}))
+	defer srv.Close()
+
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testIndexClient(target)
+
+	entries, err := c.get(context.Background(), "example.com", time.Time{}, DefaultFilter())
+	if err != nil {
+		t.Fatalf("get() error = %v, want nil", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("get() returned %d entries, want 1", len(entries))
+	}
+	if got := atomic.LoadInt32(&hits); got != int32(len(statuses)) {
+		t.Errorf("server saw %d requests, want %d", got, len(statuses))
+	}
+}
+
+// TestIndexClientGetHonorsRetryAfter confirms a Retry-After header overrides
+// the computed backoff: with a huge configured MinBackoff/MaxBackoff and a
+// Retry-After of 1 second, get should still return in about a second rather
+// than waiting out the configured backoff.
+func TestIndexClientGetHonorsRetryAfter(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, `{"Path":"example.com/foo","Version":"v1.0.0"}`)
+	}))
+	defer srv.Close()
+
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testIndexClient(target)
+	c.MinBackoff = time.Hour
+	c.MaxBackoff = time.Hour
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.get(context.Background(), "example.com", time.Time{}, DefaultFilter())
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("get() error = %v, want nil", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("get() did not return promptly; Retry-After was not honored over the configured backoff")
+	}
+}
+
+// TestIndexClientGetContextCancellation confirms a canceled context aborts
+// an in-flight retry loop promptly rather than running it out to
+// MaxRetries.
+func TestIndexClientGetContextCancellation(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testIndexClient(target)
+	c.MinBackoff = time.Hour
+	c.MaxBackoff = time.Hour
+	c.MaxRetries = 1000
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.get(ctx, "example.com", time.Time{}, DefaultFilter())
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("get() error = %v, want context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("get() did not abort promptly on context cancellation")
+	}
+}
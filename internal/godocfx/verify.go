@@ -0,0 +1,427 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build go1.15
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/sumdb"
+
+	licenseclassifier "github.com/google/licenseclassifier/v2"
+)
+
+// LicenseClassification is the result of running a module's source through
+// a license classifier.
+type LicenseClassification struct {
+	// SPDX is the SPDX identifier of the best-matching license (e.g.
+	// "Apache-2.0"), or "" if no license file cleared the verifier's
+	// LicenseThreshold.
+	SPDX string
+	// Confidence is the classifier's confidence in SPDX, in [0, 1].
+	Confidence float64
+}
+
+// enrichedEntry decorates an indexEntry with the tamper-evidence and
+// licensing metadata gathered by verifier.verify.
+type enrichedEntry struct {
+	indexEntry
+
+	// ChecksumVerified is true if the module's go.sum-style hash was
+	// confirmed against a signed tree head from sum.golang.org.
+	ChecksumVerified bool
+
+	License LicenseClassification
+}
+
+// verifier enriches indexEntry values with checksum-database verification
+// and license classification.
+type verifier struct {
+	HTTPClient *http.Client
+
+	// SumDBURL is the base URL of the checksum database, e.g.
+	// "https://sum.golang.org".
+	SumDBURL string
+
+	// VerifierKey is the sum.golang.org note-verifier key used by
+	// sumdb.Client to check the signed tree head covering each lookup,
+	// in the format golang.org/x/mod/sumdb/note.NewVerifier accepts.
+	VerifierKey string
+
+	// ProxyURL is the module proxy used to download zips for license
+	// classification, e.g. "https://proxy.golang.org".
+	ProxyURL string
+
+	// LicenseThreshold is the minimum classifier confidence, in [0, 1],
+	// required before License.SPDX is set. Matches below this are
+	// reported as unknown.
+	LicenseThreshold float64
+
+	// LicenseCorpusDir is a directory of reference license texts passed
+	// to (*licenseclassifier.Classifier).LoadLicenses, e.g. a checkout
+	// of github.com/google/licenseclassifier/v2/licenses.
+	LicenseCorpusDir string
+
+	// MaxRetries, MinBackoff, MaxBackoff, and RequestTimeout govern get's
+	// retry behavior against SumDBURL and ProxyURL, the same as the
+	// identically-named indexClient fields do for index.golang.org.
+	MaxRetries     int
+	MinBackoff     time.Duration
+	MaxBackoff     time.Duration
+	RequestTimeout time.Duration
+
+	classifierOnce sync.Once
+	classifier     *licenseclassifier.Classifier
+	classifierErr  error
+}
+
+// newVerifier returns a verifier pointed at the public checksum database
+// and module proxy, with a default license confidence threshold of 0.8.
+// Callers must still set VerifierKey.
+func newVerifier() *verifier {
+	return &verifier{
+		SumDBURL:         "https://sum.golang.org",
+		ProxyURL:         "https://proxy.golang.org",
+		LicenseThreshold: 0.8,
+		MaxRetries:       5,
+		MinBackoff:       1 * time.Second,
+		MaxBackoff:       30 * time.Second,
+		RequestTimeout:   30 * time.Second,
+	}
+}
+
+// verify fetches e's entry from the checksum database, validates its
+// signed tree head, downloads the module zip from the proxy, and
+// classifies the license found inside it. out.ChecksumVerified can come
+// back false with a nil error: that means the lookup completed but the
+// proof didn't hold, as opposed to err, which means the lookup itself
+// failed (a network problem, say) and ChecksumVerified says nothing.
+func (v *verifier) verify(ctx context.Context, e indexEntry) (enrichedEntry, error) {
+	out := enrichedEntry{indexEntry: e}
+
+	ok, err := v.verifyChecksum(ctx, e)
+	if err != nil {
+		return out, fmt.Errorf("verifying checksum for %s@%s: %w", e.Path, e.Version, err)
+	}
+	out.ChecksumVerified = ok
+
+	lic, err := v.classifyLicense(ctx, e)
+	if err != nil {
+		return out, fmt.Errorf("classifying license for %s@%s: %w", e.Path, e.Version, err)
+	}
+	out.License = lic
+
+	return out, nil
+}
+
+// verifyChecksum fetches e's go.sum lines from the checksum database and
+// confirms they're bound to a Merkle inclusion proof against the signed
+// tree described by sum.golang.org, rather than merely checking that some
+// validly-signed note trails the response. sumdb.Client owns that proof
+// verification; this just wires it up to HTTP and an in-memory tile cache.
+//
+// A false result without an error means the lookup completed but the proof
+// didn't hold -- a genuine tamper or inconsistency finding, distinct from a
+// network or server error that merely prevented the lookup from completing.
+// Callers should treat the two differently: the former is a verification
+// outcome worth recording, the latter is worth surfacing and possibly
+// retrying rather than silently treated as "unverified".
+func (v *verifier) verifyChecksum(ctx context.Context, e indexEntry) (bool, error) {
+	client := sumdb.NewClient(&sumDBOps{v: v, ctx: ctx})
+	if _, err := client.Lookup(e.Path, e.Version); err != nil {
+		if errors.Is(err, sumdb.ErrSecurity) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// sumDBOps implements sumdb.ClientOps on top of verifier's HTTP client, so
+// sumdb.Client can perform the Merkle-proof verification that binds a
+// lookup's go.sum lines to the signed tree covering them. There's no
+// on-disk state to persist between runs: ReadConfig/WriteConfig are no-ops
+// beyond serving the verifier key, and the tile cache lives only as long
+// as ops does.
+type sumDBOps struct {
+	v   *verifier
+	ctx context.Context
+
+	cache sync.Map // name string -> []byte
+}
+
+func (o *sumDBOps) ReadRemote(path string) ([]byte, error) {
+	return o.v.get(o.ctx, o.v.SumDBURL+path)
+}
+
+func (o *sumDBOps) ReadConfig(file string) ([]byte, error) {
+	if file == "key" {
+		return []byte(o.v.VerifierKey), nil
+	}
+	// No prior state (e.g. a recorded latest tree) to report.
+	return nil, nil
+}
+
+func (o *sumDBOps) WriteConfig(file string, old, new []byte) error {
+	return nil
+}
+
+func (o *sumDBOps) ReadCache(name string) ([]byte, error) {
+	if data, ok := o.cache.Load(name); ok {
+		return data.([]byte), nil
+	}
+	return nil, errors.New("no cache entry for " + name)
+}
+
+func (o *sumDBOps) WriteCache(name string, data []byte) {
+	o.cache.Store(name, data)
+}
+
+func (o *sumDBOps) Log(msg string)           {}
+func (o *sumDBOps) SecurityError(msg string) {}
+
+// classifyLicense downloads e's module zip from the proxy and runs each
+// license-shaped file through a confidence-scored classifier, returning the
+// best match that clears v.LicenseThreshold.
+func (v *verifier) classifyLicense(ctx context.Context, e indexEntry) (LicenseClassification, error) {
+	zipURL := fmt.Sprintf("%s/%s/@v/%s.zip", v.ProxyURL, e.Path, e.Version)
+	zipData, err := v.get(ctx, zipURL)
+	if err != nil {
+		return LicenseClassification{}, err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		return LicenseClassification{}, err
+	}
+
+	classifier, err := v.getClassifier()
+	if err != nil {
+		return LicenseClassification{}, err
+	}
+
+	var best LicenseClassification
+	for _, f := range zr.File {
+		if !looksLikeLicenseFile(f.Name) {
+			continue
+		}
+		content, err := readZipFile(f)
+		if err != nil {
+			return LicenseClassification{}, err
+		}
+		for _, m := range classifier.Match(content).Matches {
+			if m.Confidence > best.Confidence {
+				best = LicenseClassification{SPDX: m.Name, Confidence: m.Confidence}
+			}
+		}
+	}
+	if best.Confidence < v.LicenseThreshold {
+		return LicenseClassification{}, nil
+	}
+	return best, nil
+}
+
+// getClassifier builds and loads v's license classifier the first time
+// it's needed. NewClassifier alone starts with an empty corpus; without
+// LoadLicenses every file would come back with zero matches, which is
+// indistinguishable from every module having an unknown license.
+func (v *verifier) getClassifier() (*licenseclassifier.Classifier, error) {
+	v.classifierOnce.Do(func() {
+		c := licenseclassifier.NewClassifier(v.LicenseThreshold)
+		if err := c.LoadLicenses(v.LicenseCorpusDir); err != nil {
+			v.classifierErr = fmt.Errorf("loading license corpus from %s: %w", v.LicenseCorpusDir, err)
+			return
+		}
+		v.classifier = c
+	})
+	return v.classifier, v.classifierErr
+}
+
+// looksLikeLicenseFile reports whether name, a path inside a module zip,
+// is conventionally where license text lives.
+func looksLikeLicenseFile(name string) bool {
+	base := strings.ToUpper(path.Base(name))
+	for _, prefix := range []string{"LICENSE", "LICENCE", "COPYING"} {
+		if strings.HasPrefix(base, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// get issues a context-aware GET request against url, retrying on 429s,
+// 5xxs, and other transient errors the same way indexClient.get retries
+// requests to index.golang.org, honoring any Retry-After header and
+// applying computeBackoff between attempts.
+func (v *verifier) get(ctx context.Context, url string) ([]byte, error) {
+	maxRetries := v.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = 1
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		if attempt > 0 {
+			d := computeBackoff(v.MinBackoff, v.MaxBackoff, attempt, lastErr)
+			log.Printf("%s: retrying after %s (attempt %d/%d): %v", url, d, attempt+1, maxRetries, lastErr)
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		data, retryAfter, err := v.getOnce(ctx, url)
+		if err == nil {
+			return data, nil
+		}
+		if !isRetryable(err) {
+			return nil, err
+		}
+		lastErr = err
+		if retryAfter > 0 {
+			// Override the computed backoff with the server's explicit wait.
+			lastErr = retryAfterError{err: err, wait: retryAfter}
+		}
+	}
+	return nil, fmt.Errorf("%s: giving up after %d attempts: %w", url, maxRetries, lastErr)
+}
+
+// getOnce issues a single HTTP request for url. retryAfter is non-zero when
+// the response carried a Retry-After header.
+func (v *verifier) getOnce(ctx context.Context, url string) (data []byte, retryAfter time.Duration, err error) {
+	reqCtx := ctx
+	if v.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, v.RequestTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	client := v.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		return nil, retryAfter, fmt.Errorf("%s: status %s", url, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%s: status %s", url, resp.Status)
+	}
+
+	data, err = io.ReadAll(resp.Body)
+	return data, 0, err
+}
+
+// permissiveLicenses are the SPDX identifiers verifyModules treats as safe
+// to index without further review.
+var permissiveLicenses = map[string]bool{
+	"Apache-2.0":   true,
+	"MIT":          true,
+	"BSD-2-Clause": true,
+	"BSD-3-Clause": true,
+	"ISC":          true,
+}
+
+// verifyModules runs each of entries through v using a bounded pool of
+// concurrency workers, the same pattern paginate uses for index pages, and
+// returns only those whose checksum verified and whose license landed on
+// permissiveLicenses. A checksum whose proof didn't hold, an unknown
+// license, or a non-permissive one drops the entry silently, on the theory
+// that callers would rather under- than over-index. An entry whose
+// verification failed outright (a lookup or download error) is dropped as
+// well, and the first such error is returned alongside the kept entries.
+func verifyModules(ctx context.Context, v *verifier, concurrency int, entries []indexEntry) ([]enrichedEntry, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	jobs := make(chan indexEntry)
+	results := make(chan enrichedEntry)
+	errs := make(chan error, 1)
+
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range jobs {
+				enriched, err := v.verify(ctx, e)
+				if err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+					continue
+				}
+				results <- enriched
+			}
+		}()
+	}
+	go func() {
+		for _, e := range entries {
+			jobs <- e
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	var kept []enrichedEntry
+	for r := range results {
+		if !r.ChecksumVerified || !permissiveLicenses[r.License.SPDX] {
+			continue
+		}
+		kept = append(kept, r)
+	}
+
+	select {
+	case err := <-errs:
+		return kept, err
+	default:
+		return kept, nil
+	}
+}
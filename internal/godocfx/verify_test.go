@@ -0,0 +1,39 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build go1.15
+
+package main
+
+import "testing"
+
+func TestLooksLikeLicenseFile(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"LICENSE", true},
+		{"LICENSE.md", true},
+		{"LICENSE-MIT", true},
+		{"vendor/foo/LICENCE", true},
+		{"COPYING", true},
+		{"README.md", false},
+		{"licenses/apache.txt", false},
+	}
+	for _, tt := range tests {
+		if got := looksLikeLicenseFile(tt.name); got != tt.want {
+			t.Errorf("looksLikeLicenseFile(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}